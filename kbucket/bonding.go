@@ -0,0 +1,98 @@
+package kbucket
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// pendingPing tracks an outstanding endpoint-proof challenge for a node we
+// have not yet verified at its claimed (IP, Port). The token is bound to
+// that tuple so a pong observed from a different address can never satisfy
+// it, which is what keeps a spoofed FIND/STORE source from getting its
+// forged address inserted into routes.
+type pendingPing struct {
+	node     Node
+	expected [16]byte
+	ip       net.IP
+	port     uint32
+	deadline time.Time
+}
+
+type pongArg struct {
+	nid   NodeID
+	token [16]byte
+	ip    net.IP
+	port  uint32
+}
+
+const bondTimeout = 10 * time.Second
+
+// bond starts (or, if still live, leaves alone) an endpoint-proof challenge
+// for n. n is only handed to commit once a matching pong arrives.
+func (k *Kbucket) bond(n Node) {
+	if p, ok := k.pendingPings[n.ID]; ok && p.ip.Equal(n.IP) && p.port == n.Port && time.Now().Before(p.deadline) {
+		return
+	}
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		golog.Error(err)
+		return
+	}
+	k.pendingPings[n.ID] = pendingPing{
+		node:     n,
+		expected: token,
+		ip:       n.IP,
+		port:     n.Port,
+		deadline: time.Now().Add(bondTimeout),
+	}
+	go k.challenge(n, token)
+}
+
+// challenge sends the endpoint-proof ping over Sender. The actual pong is
+// delivered back asynchronously through OnPong, since a node bonded from an
+// incoming FIND/STORE must not block the run loop while it waits.
+func (k *Kbucket) challenge(n Node, token [16]byte) {
+	if _, err := k.send(context.Background(), MailPing, []interface{}{n, token}); err != nil {
+		golog.Error(err)
+		k.emit(note{typ: nPingFailed, arg: n.ID})
+	}
+}
+
+// OnPong completes an outstanding endpoint proof. The transport layer must
+// call this with the token and the (ip, port) the pong actually arrived
+// from, never the address the node claims, so a proof for one address can't
+// be replayed to authorize another.
+func (k *Kbucket) OnPong(nid NodeID, token [16]byte, ip net.IP, port uint32) {
+	k.emit(note{
+		typ: nPong,
+		arg: pongArg{nid: nid, token: token, ip: ip, port: port},
+	})
+}
+
+func (k *Kbucket) handlePong(a pongArg) {
+	p, ok := k.pendingPings[a.nid]
+	if !ok {
+		return
+	}
+	if !p.ip.Equal(a.ip) || p.port != a.port || p.expected != a.token {
+		return
+	}
+	delete(k.pendingPings, a.nid)
+	k.recordPongFrom(a.nid)
+	k.commit(p.node)
+}
+
+// gcPendingPings drops endpoint-proof challenges that timed out without a
+// matching pong, run on the same ticker as the rest of table maintenance.
+func (k *Kbucket) gcPendingPings() {
+	now := time.Now()
+	for nid, p := range k.pendingPings {
+		if now.After(p.deadline) {
+			delete(k.pendingPings, nid)
+		}
+	}
+}
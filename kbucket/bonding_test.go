@@ -0,0 +1,78 @@
+package kbucket
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestKbucket() *Kbucket {
+	self := NewNode(idFor(0xFF), net.ParseIP("127.0.0.1"), 9000)
+	return &Kbucket{
+		routes:       make(map[int]KQue),
+		Self:         &self,
+		k:            kcount,
+		alpha:        alpha,
+		pendingPings: make(map[NodeID]pendingPing),
+		meta:         make(map[NodeID]*nodeMeta),
+		closed:       make(chan struct{}),
+	}
+}
+
+func TestHandlePongRejectsMismatchedAddress(t *testing.T) {
+	k := newTestKbucket()
+	n := nodeFor(1)
+	k.pendingPings[n.ID] = pendingPing{
+		node:     n,
+		expected: [16]byte{1, 2, 3},
+		ip:       n.IP,
+		port:     n.Port,
+		deadline: time.Now().Add(time.Minute),
+	}
+	k.handlePong(pongArg{nid: n.ID, token: [16]byte{1, 2, 3}, ip: net.ParseIP("10.0.0.1"), port: n.Port})
+
+	if _, ok := k.pendingPings[n.ID]; !ok {
+		t.Fatal("pong from a different address should not have completed the bond")
+	}
+	if k.bonded(n) {
+		t.Fatal("node should not have been committed to routes")
+	}
+}
+
+func TestHandlePongRejectsWrongToken(t *testing.T) {
+	k := newTestKbucket()
+	n := nodeFor(1)
+	k.pendingPings[n.ID] = pendingPing{
+		node:     n,
+		expected: [16]byte{1, 2, 3},
+		ip:       n.IP,
+		port:     n.Port,
+		deadline: time.Now().Add(time.Minute),
+	}
+	k.handlePong(pongArg{nid: n.ID, token: [16]byte{9, 9, 9}, ip: n.IP, port: n.Port})
+
+	if k.bonded(n) {
+		t.Fatal("node should not have been committed on a mismatched token")
+	}
+}
+
+func TestHandlePongCommitsOnMatchingAddressAndToken(t *testing.T) {
+	k := newTestKbucket()
+	n := nodeFor(1)
+	token := [16]byte{9, 9, 9}
+	k.pendingPings[n.ID] = pendingPing{
+		node:     n,
+		expected: token,
+		ip:       n.IP,
+		port:     n.Port,
+		deadline: time.Now().Add(time.Minute),
+	}
+	k.handlePong(pongArg{nid: n.ID, token: token, ip: n.IP, port: n.Port})
+
+	if _, ok := k.pendingPings[n.ID]; ok {
+		t.Fatal("matching pong should have cleared the pending challenge")
+	}
+	if !k.bonded(n) {
+		t.Fatal("expected node to be committed to routes after a matching pong")
+	}
+}
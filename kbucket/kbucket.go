@@ -1,14 +1,21 @@
 package kbucket
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/kataras/golog"
+
+	"github.com/ZhangTao1596/kad/nodedb"
 )
 
+//ErrClosed is returned by every exported method once Close has been called.
+var ErrClosed = errors.New("kbucket: closed")
+
 type (
 	notetype uint8
 	MailType uint8
@@ -16,6 +23,7 @@ type (
 		typ    notetype
 		arg    interface{}
 		result chan interface{}
+		ctx    context.Context
 	}
 	Mail struct {
 		Type   MailType
@@ -27,6 +35,20 @@ type (
 		LocalIP net.IP
 		Port    uint32
 		ID      NodeID
+
+		//PersistPath, if non-empty, is where the node database is opened.
+		//An empty path disables persistence entirely.
+		PersistPath string
+		SeedCount   int
+		SeedMaxAge  time.Duration
+
+		//RepublishInterval and ReplicateInterval tune Store's durability
+		//cycle: the originator of a key re-runs its replication fan-out
+		//every RepublishInterval, while non-originator holders do the same
+		//every ReplicateInterval unless a peer has re-stored the key with
+		//them more recently. Zero uses the package defaults.
+		RepublishInterval time.Duration
+		ReplicateInterval time.Duration
 	}
 	Kbucket struct {
 		config   *KbConfig
@@ -38,20 +60,43 @@ type (
 		ticker   *time.Ticker
 		receiver chan note
 		Sender   chan Mail
+
+		pendingPings      map[NodeID]pendingPing
+		db                *nodedb.DB
+		meta              map[NodeID]*nodeMeta
+		lastRefresh       map[int]time.Time
+		topics            map[string]*topicState
+		storeMeta         map[string]*storeMeta
+		republishInterval time.Duration
+		replicateInterval time.Duration
+
+		closed    chan struct{}
+		closeOnce sync.Once
 	}
 )
 
 const (
-	nDelNode notetype = 0x01
-	nAddNode notetype = 0x02
-	nFindOne notetype = 0x03
-	nFind    notetype = 0x04
-	nStore   notetype = 0x05
+	nDelNode    notetype = 0x01
+	nAddNode    notetype = 0x02
+	nFindOne    notetype = 0x03
+	nFind       notetype = 0x04
+	nStore      notetype = 0x05
+	nPong       notetype = 0x06
+	nPingFailed notetype = 0x07
+	nEvict      notetype = 0x08
+	nTouch      notetype = 0x09
+	nTopicStore notetype = 0x0A
+	nTopicQuery notetype = 0x0B
+	nGet        notetype = 0x0C
 )
 
 const (
-	MailPing MailType = 0x06
-	MailFind MailType = 0x07
+	MailPing       MailType = 0x06
+	MailFind       MailType = 0x07
+	MailPong       MailType = 0x08
+	MailStore      MailType = 0x09
+	MailTopicStore MailType = 0x0A
+	MailTopicQuery MailType = 0x0B
 )
 const (
 	kcount = 8
@@ -62,6 +107,14 @@ const (
 //New create a kbucket
 func New(config *KbConfig) *Kbucket {
 	n := NewNode(config.ID, config.LocalIP, config.Port)
+	republishInterval := config.RepublishInterval
+	if republishInterval <= 0 {
+		republishInterval = defaultRepublishInterval
+	}
+	replicateInterval := config.ReplicateInterval
+	if replicateInterval <= 0 {
+		replicateInterval = defaultReplicateInterval
+	}
 	k := &Kbucket{
 		config:   config,
 		routes:   make(map[int]KQue, 64),
@@ -71,21 +124,74 @@ func New(config *KbConfig) *Kbucket {
 		alpha:    alpha,
 		receiver: make(chan note),
 		Sender:   make(chan Mail),
+
+		pendingPings:      make(map[NodeID]pendingPing),
+		meta:              make(map[NodeID]*nodeMeta),
+		lastRefresh:       make(map[int]time.Time),
+		topics:            make(map[string]*topicState),
+		storeMeta:         make(map[string]*storeMeta),
+		republishInterval: republishInterval,
+		replicateInterval: replicateInterval,
+
+		closed: make(chan struct{}),
 	}
 	k.ticker = time.NewTicker(ticktm)
+	if config.PersistPath != "" {
+		db, err := nodedb.Open(config.PersistPath)
+		if err != nil {
+			golog.Error(err)
+		} else {
+			k.db = db
+		}
+	}
 	return k
 }
 
 func (k *Kbucket) Start() {
 	go k.run()
+	k.seed()
+}
+
+// Close stops the ticker and the run goroutine. It is safe to call more
+// than once; only the first call has any effect.
+func (k *Kbucket) Close() error {
+	k.closeOnce.Do(func() {
+		k.ticker.Stop()
+		close(k.closed)
+		if k.db != nil {
+			if err := k.db.Close(); err != nil {
+				golog.Error(err)
+			}
+		}
+	})
+	return nil
 }
 
 func (k *Kbucket) run() {
 	for {
 		select {
+		case <-k.closed:
+			return
 		case <-k.ticker.C:
 			golog.Info("[kbucket.run] routes: ", k.routes)
+			k.gcPendingPings()
+			k.flush()
+			k.refreshStale()
+			for _, key := range k.store.expire() {
+				delete(k.storeMeta, key)
+			}
+			k.replicateDue()
 		case msg := <-k.receiver:
+			if msg.ctx != nil {
+				select {
+				case <-msg.ctx.Done():
+					if msg.result != nil {
+						close(msg.result)
+					}
+					continue
+				default:
+				}
+			}
 			switch msg.typ {
 			case nAddNode:
 				n := msg.arg.(Node)
@@ -93,31 +199,94 @@ func (k *Kbucket) run() {
 			case nDelNode:
 				n := msg.arg.(Node)
 				k.remove(n)
+			case nPong:
+				k.handlePong(msg.arg.(pongArg))
+			case nPingFailed:
+				k.recordPingFailure(msg.arg.(NodeID))
+			case nEvict:
+				k.handleEvict(msg.arg.(evictArg))
+			case nTouch:
+				k.handleTouch(msg.arg.(touchArg))
+			case nTopicStore:
+				k.handleTopicStore(msg.arg.(topicStoreArg))
+			case nTopicQuery:
+				topic := msg.arg.(string)
+				k.topicAds(topic, msg.result)
 			case nFind:
 				nid := msg.arg.(NodeID)
-				k.find(nid, msg.result)
+				k.find(msg.ctx, nid, msg.result)
 			case nFindOne:
 				nid := msg.arg.(NodeID)
-				k.findOne(nid, msg.result)
+				k.findOne(msg.ctx, nid, msg.result)
 			case nStore:
-				kv := msg.arg.(struct {
-					key   string
-					value string
-				})
-				k.storeKV(kv.key, kv.value)
+				k.storeKV(msg.arg.(storeArg))
+			case nGet:
+				k.getLocal(msg.arg.(string), msg.result)
 			}
 		}
 	}
 }
 
+// emit hands a note to the run loop the same way the public methods do,
+// except fire-and-forget: used by the On* wire callbacks and internal
+// goroutines that have no caller context or result channel to select on.
+// It still bails out on k.closed instead of blocking forever, so a note
+// raised after Close (or racing with it) can't leak the calling goroutine.
+func (k *Kbucket) emit(n note) {
+	select {
+	case k.receiver <- n:
+	case <-k.closed:
+	}
+}
+
 //AddNode to add a node
-func (k *Kbucket) AddNode(n Node) {
-	k.receiver <- note{
-		typ: nAddNode,
-		arg: n,
+func (k *Kbucket) AddNode(ctx context.Context, n Node) error {
+	select {
+	case k.receiver <- note{typ: nAddNode, arg: n, ctx: ctx}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-k.closed:
+		return ErrClosed
 	}
 }
+
+// add is the entrypoint for every incoming FIND/STORE/ADD path. An
+// unverified (ID, IP, Port) is never committed directly; it must first
+// complete an endpoint proof (see bond/OnPong).
 func (k *Kbucket) add(n Node) {
+	if !k.bonded(n) {
+		k.bond(n)
+		return
+	}
+	k.commit(n)
+}
+
+// bonded reports whether n's (ID, IP, Port) already matches an entry we
+// hold, meaning it was verified by a prior endpoint proof and can be
+// committed straight away.
+func (k *Kbucket) bonded(n Node) bool {
+	distance, err := CalDistance(n.ID, k.Self.ID)
+	if err != nil {
+		golog.Error(err)
+		return false
+	}
+	partion := distance.Partion()
+	que, ok := k.routes[partion]
+	if !ok {
+		return false
+	}
+	ok, existing := que.findOne(n.ID)
+	return ok && existing.IP.Equal(n.IP) && existing.Port == n.Port
+}
+
+// commit inserts n into its bucket. If the bucket is already full, Kademlia's
+// least-recently-seen eviction kicks in: the stalest occupant is pinged, and
+// only replaced by n if that ping fails; otherwise the occupant is touched
+// (moved to the tail) and n is kept only as a replacement candidate. This is
+// the standard Kademlia defense against an attacker flooding a bucket with
+// sybils to push out good nodes.
+func (k *Kbucket) commit(n Node) {
 	distance, err := CalDistance(n.ID, k.Self.ID)
 	if err != nil {
 		golog.Error(err)
@@ -126,20 +295,35 @@ func (k *Kbucket) add(n Node) {
 	var que KQue
 	if _, ok := k.routes[partion]; !ok {
 		que = newKQue(k)
+		k.routes[partion] = que
 	} else {
 		que = k.routes[partion]
 	}
+	if que.Full() && !que.Has(n.ID) {
+		lru, ok := que.LeastRecentlySeen()
+		if ok {
+			go k.evictOrTouch(partion, lru, n)
+			return
+		}
+	}
 	qptr := &que
 	qptr.updateAdd(n)
 	k.routes[partion] = que
+	if _, ok := k.meta[n.ID]; !ok {
+		k.meta[n.ID] = &nodeMeta{addedAt: time.Now()}
+	}
 	return
 }
 
 //RemoveNode to remove a node
-func (k *Kbucket) RemoveNode(n Node) {
-	k.receiver <- note{
-		typ: nDelNode,
-		arg: n,
+func (k *Kbucket) RemoveNode(ctx context.Context, n Node) error {
+	select {
+	case k.receiver <- note{typ: nDelNode, arg: n, ctx: ctx}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-k.closed:
+		return ErrClosed
 	}
 }
 func (k *Kbucket) remove(n Node) {
@@ -156,22 +340,28 @@ func (k *Kbucket) remove(n Node) {
 	k.routes[partion] = que
 	return
 }
-func (k *Kbucket) Find(nid NodeID) (ns []Node, err error) {
+func (k *Kbucket) Find(ctx context.Context, nid NodeID) (ns []Node, err error) {
 	phone := make(chan interface{})
-	k.receiver <- note{
-		typ:    nFind,
-		arg:    nid,
-		result: phone,
+	select {
+	case k.receiver <- note{typ: nFind, arg: nid, result: phone, ctx: ctx}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-k.closed:
+		return nil, ErrClosed
 	}
-	result, ok := <-phone
-	if !ok {
-		return ns, errors.New("Failed")
+	select {
+	case result, ok := <-phone:
+		if !ok {
+			return ns, errors.New("Failed")
+		}
+		return result.([]Node), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return result.([]Node), nil
 }
 
 //Find find alpha nodes that are closest to the nid
-func (k *Kbucket) find(nid NodeID, phone chan interface{}) {
+func (k *Kbucket) find(ctx context.Context, nid NodeID, phone chan interface{}) {
 	defer close(phone)
 	var ns []Node
 	if k.Self.ID.Equal(nid) {
@@ -184,10 +374,12 @@ func (k *Kbucket) find(nid NodeID, phone chan interface{}) {
 	}
 	partion := dist.Partion()
 	if kq, ok := k.routes[partion]; ok {
-		ns, err = kq.findN(nid, k.alpha)
+		res, err := kq.findN(nid, k.alpha)
 		if err != nil {
 			return
 		}
+		ns = k.onlyVerified(res)
+		k.lastRefresh[partion] = time.Now()
 	}
 	if k.alpha <= len(ns) {
 		return
@@ -210,45 +402,64 @@ func (k *Kbucket) find(nid NodeID, phone chan interface{}) {
 			if err != nil {
 				return
 			}
-			for _, v := range res {
-				ns = append(ns, v)
-			}
+			ns = append(ns, k.onlyVerified(res)...)
 			if k.alpha <= len(ns) {
 				break
 			}
 		}
 	}
-	phone <- ns
+	select {
+	case phone <- ns:
+	case <-ctx.Done():
+	}
 }
 
-func (k *Kbucket) FindOne(nid NodeID) (Node, error) {
+func (k *Kbucket) FindOne(ctx context.Context, nid NodeID) (Node, error) {
 	phone := make(chan interface{})
-	k.receiver <- note{
-		typ:    nFindOne,
-		arg:    nid,
-		result: phone,
+	select {
+	case k.receiver <- note{typ: nFindOne, arg: nid, result: phone, ctx: ctx}:
+	case <-ctx.Done():
+		return Node{}, ctx.Err()
+	case <-k.closed:
+		return Node{}, ErrClosed
 	}
-	result, ok := <-phone
-	if !ok {
-		return Node{}, errors.New("Failed")
+	select {
+	case result, ok := <-phone:
+		if !ok {
+			return Node{}, errors.New("Failed")
+		}
+		return result.(Node), nil
+	case <-ctx.Done():
+		return Node{}, ctx.Err()
 	}
-	return result.(Node), nil
 }
 
-func (k *Kbucket) findOne(nid NodeID, phone chan interface{}) (Node, error) {
+func (k *Kbucket) findOne(ctx context.Context, nid NodeID, phone chan interface{}) {
+	defer close(phone)
+	n, err := k.findOneLocal(nid)
+	if err != nil {
+		return
+	}
+	select {
+	case phone <- n:
+	case <-ctx.Done():
+	}
+}
+
+func (k *Kbucket) findOneLocal(nid NodeID) (Node, error) {
 	if k.Self.ID.Equal(nid) {
 		return *k.Self, nil
 	}
 	dist, err := CalDistance(nid, k.Self.ID)
 	if err != nil {
 		golog.Error(err)
-		return Node{}, nil
+		return Node{}, err
 	}
 	partion := dist.Partion()
 	kq, ok := k.routes[partion]
 	if ok {
 		ok, n := kq.findOne(nid)
-		if ok {
+		if ok && k.verified(n.ID) {
 			return n, nil
 		}
 	}
@@ -268,7 +479,7 @@ func (k *Kbucket) findOne(nid NodeID, phone chan interface{}) (Node, error) {
 		kq, ok := k.routes[v]
 		if ok {
 			ok, n := kq.findOne(nid)
-			if ok {
+			if ok && k.verified(n.ID) {
 				return n, nil
 			}
 		}
@@ -276,45 +487,34 @@ func (k *Kbucket) findOne(nid NodeID, phone chan interface{}) (Node, error) {
 	return Node{}, errors.New("NOT FOUND")
 }
 
-func (k *Kbucket) Store(key, value string) {
-	k.receiver <- note{
-		typ: nStore,
-		arg: struct {
-			key   string
-			value string
-		}{key, value},
-	}
-}
-func (k *Kbucket) storeKV(key, value string) {
-	k.store.Put(key, value)
+//Ping sends an endpoint-proof-style ping to n and waits for the pong.
+func (k *Kbucket) Ping(ctx context.Context, n Node) error {
+	_, err := k.send(ctx, MailPing, []interface{}{n})
+	return err
 }
 
-func (k *Kbucket) send(mt MailType, data []interface{}) (interface{}, error) {
-	switch mt {
-	case MailPing:
-		mail := Mail{
-			Type:   mt,
-			Arg:    data,
-			Result: make(chan interface{}),
-		}
-		k.Sender <- mail
-		nid, ok := <-mail.Result
-		if !ok {
-			return nil, errors.New("Ping Failed")
-		}
-		return nid, nil
-	case MailFind:
-		mail := Mail{
-			Type:   mt,
-			Arg:    data,
-			Result: make(chan interface{}),
-		}
-		k.Sender <- mail
-		ns, ok := <-mail.Result
+// send ships mt out over Sender and blocks for whatever the transport layer
+// writes back on the mail's own Result channel, or until ctx is done.
+func (k *Kbucket) send(ctx context.Context, mt MailType, data []interface{}) (interface{}, error) {
+	mail := Mail{
+		Type:   mt,
+		Arg:    data,
+		Result: make(chan interface{}),
+	}
+	select {
+	case k.Sender <- mail:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-k.closed:
+		return nil, ErrClosed
+	}
+	select {
+	case result, ok := <-mail.Result:
 		if !ok {
-			return nil, errors.New("Find Failed")
+			return nil, errors.New("Mail Failed")
 		}
-		return ns, nil
+		return result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return nil, nil
 }
@@ -0,0 +1,151 @@
+package kbucket
+
+import (
+	"sort"
+	"time"
+)
+
+// replacementCap bounds the replacement cache kept alongside a full bucket's
+// live entries: candidates that couldn't be admitted while the bucket was
+// full, kept around in case a live entry later turns out to be dead.
+const replacementCap = 8
+
+// kqEntry is one live occupant of a KQue, ordered by lastSeen so the head
+// of entries is always the least-recently-seen occupant.
+type kqEntry struct {
+	node     Node
+	lastSeen time.Time
+}
+
+// KQue is a single Kademlia bucket: up to capacity live entries ordered
+// oldest-seen-first, plus a small replacement cache of backup candidates
+// that arrived while the bucket was already full. Per the standard
+// Kademlia eviction policy, a full bucket is never grown past capacity by
+// a newcomer directly; the newcomer only goes into entries by way of
+// commit/evictOrTouch replacing the least-recently-seen occupant.
+type KQue struct {
+	capacity     int
+	entries      []kqEntry
+	replacements []Node
+}
+
+// newKQue creates an empty bucket sized to k's configured bucket capacity.
+func newKQue(k *Kbucket) KQue {
+	return KQue{capacity: k.k}
+}
+
+// Full reports whether the bucket already holds capacity live entries.
+func (kq *KQue) Full() bool {
+	return len(kq.entries) >= kq.capacity
+}
+
+// Has reports whether id is already a live entry in the bucket.
+func (kq *KQue) Has(id NodeID) bool {
+	ok, _ := kq.findOne(id)
+	return ok
+}
+
+// findOne returns the live entry for id, if any.
+func (kq *KQue) findOne(id NodeID) (bool, Node) {
+	for _, e := range kq.entries {
+		if e.node.ID.Equal(id) {
+			return true, e.node
+		}
+	}
+	return false, Node{}
+}
+
+// findN returns up to n live entries, sorted by XOR distance to target.
+func (kq *KQue) findN(target NodeID, n int) ([]Node, error) {
+	type distEntry struct {
+		node Node
+		dist Distance
+	}
+	list := make([]distEntry, 0, len(kq.entries))
+	for _, e := range kq.entries {
+		d, err := CalDistance(e.node.ID, target)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, distEntry{node: e.node, dist: d})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].dist.Compare(list[j].dist) < 0
+	})
+	if n > len(list) {
+		n = len(list)
+	}
+	out := make([]Node, n)
+	for i := 0; i < n; i++ {
+		out[i] = list[i].node
+	}
+	return out, nil
+}
+
+// All returns every live entry in the bucket, in no particular order.
+func (kq *KQue) All() []Node {
+	out := make([]Node, len(kq.entries))
+	for i, e := range kq.entries {
+		out[i] = e.node
+	}
+	return out
+}
+
+// LeastRecentlySeen returns the bucket's stalest live entry, the one
+// commit pings before evicting in favor of a newcomer.
+func (kq *KQue) LeastRecentlySeen() (Node, bool) {
+	if len(kq.entries) == 0 {
+		return Node{}, false
+	}
+	return kq.entries[0].node, true
+}
+
+// updateAdd inserts n as the most-recently-seen entry, or, if an entry for
+// n.ID is already present, replaces it with n and moves it to
+// most-recently-seen. Replacing rather than keeping the old entry matters
+// when a node re-bonds at a new (IP, Port): otherwise its routing-table
+// entry would stay stuck on the old, dead address.
+func (kq *KQue) updateAdd(n Node) {
+	for i, e := range kq.entries {
+		if e.node.ID.Equal(n.ID) {
+			kq.entries = append(kq.entries[:i], kq.entries[i+1:]...)
+			kq.entries = append(kq.entries, kqEntry{node: n, lastSeen: time.Now()})
+			return
+		}
+	}
+	kq.entries = append(kq.entries, kqEntry{node: n, lastSeen: time.Now()})
+}
+
+// remove drops n from the bucket's live entries, if present.
+func (kq *KQue) remove(n Node) {
+	for i, e := range kq.entries {
+		if e.node.ID.Equal(n.ID) {
+			kq.entries = append(kq.entries[:i], kq.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// touch marks n as most-recently-seen without changing bucket membership,
+// used when a least-recently-seen occupant answers its liveness ping and
+// keeps its slot instead of being evicted.
+func (kq *KQue) touch(n Node) {
+	kq.updateAdd(n)
+}
+
+// addReplacement records n as a backup candidate for this bucket, evicting
+// the oldest replacement first once the cache is at capacity. A node
+// already in the cache is refreshed to most-recently-added instead of
+// being duplicated.
+func (kq *KQue) addReplacement(n Node) {
+	for i, r := range kq.replacements {
+		if r.ID.Equal(n.ID) {
+			kq.replacements = append(kq.replacements[:i], kq.replacements[i+1:]...)
+			break
+		}
+	}
+	kq.replacements = append(kq.replacements, n)
+	if len(kq.replacements) > replacementCap {
+		kq.replacements = kq.replacements[len(kq.replacements)-replacementCap:]
+	}
+}
@@ -0,0 +1,73 @@
+package kbucket
+
+import (
+	"net"
+	"testing"
+)
+
+func idFor(b byte) NodeID {
+	var id NodeID
+	id[len(id)-1] = b
+	return id
+}
+
+func nodeFor(b byte) Node {
+	return NewNode(idFor(b), net.ParseIP("127.0.0.1"), uint32(b))
+}
+
+func TestKQueLeastRecentlySeenIsOldest(t *testing.T) {
+	kq := KQue{capacity: 2}
+	kq.updateAdd(nodeFor(1))
+	kq.updateAdd(nodeFor(2))
+
+	lru, ok := kq.LeastRecentlySeen()
+	if !ok || !lru.ID.Equal(idFor(1)) {
+		t.Fatalf("expected node 1 as least recently seen, got %+v", lru)
+	}
+
+	kq.touch(nodeFor(1))
+	lru, ok = kq.LeastRecentlySeen()
+	if !ok || !lru.ID.Equal(idFor(2)) {
+		t.Fatalf("expected node 2 as least recently seen after touching node 1, got %+v", lru)
+	}
+}
+
+func TestKQueUpdateAddReplacesAddressOnRebond(t *testing.T) {
+	kq := KQue{capacity: 1}
+	kq.updateAdd(NewNode(idFor(1), net.ParseIP("127.0.0.1"), 1000))
+	kq.updateAdd(NewNode(idFor(1), net.ParseIP("10.0.0.9"), 2000))
+
+	ok, n := kq.findOne(idFor(1))
+	if !ok {
+		t.Fatal("expected the entry to still be present")
+	}
+	if !n.IP.Equal(net.ParseIP("10.0.0.9")) || n.Port != 2000 {
+		t.Fatalf("expected the re-bonded address to replace the old one, got %+v", n)
+	}
+}
+
+func TestKQueFullAtCapacity(t *testing.T) {
+	kq := KQue{capacity: 1}
+	if kq.Full() {
+		t.Fatal("empty bucket should not report full")
+	}
+	kq.updateAdd(nodeFor(1))
+	if !kq.Full() {
+		t.Fatal("bucket at capacity should report full")
+	}
+}
+
+func TestKQueAddReplacementCapsAndEvictsOldest(t *testing.T) {
+	var kq KQue
+	for i := 0; i < replacementCap+1; i++ {
+		kq.addReplacement(nodeFor(byte(i)))
+	}
+	if len(kq.replacements) != replacementCap {
+		t.Fatalf("expected replacement cache capped at %d, got %d", replacementCap, len(kq.replacements))
+	}
+	for _, r := range kq.replacements {
+		if r.ID.Equal(idFor(0)) {
+			t.Fatal("expected the oldest replacement to have been evicted")
+		}
+	}
+}
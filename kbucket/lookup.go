@@ -0,0 +1,282 @@
+package kbucket
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/kataras/golog"
+)
+
+type lookupState uint8
+
+const (
+	lookupPending lookupState = iota
+	lookupQueried
+	lookupFailed
+	lookupResponded
+)
+
+// lookupCandidate is a shortlist entry for one in-flight iterative lookup.
+type lookupCandidate struct {
+	node     Node
+	distance Distance
+	state    lookupState
+}
+
+// findReply is what a remote peer sends back for a MailFind round trip: the
+// nodes it knows closest to the target, plus (for a value lookup) the value
+// itself if it happens to hold one for Key.
+type findReply struct {
+	Nodes []Node
+	Value string
+	Found bool
+}
+
+type lookupResult struct {
+	id    NodeID
+	reply findReply
+	err   error
+}
+
+// Lookup drives an iterative Kademlia FIND_NODE lookup for target and
+// returns the k nodes closest to it that actually responded.
+func (k *Kbucket) Lookup(ctx context.Context, target NodeID) ([]Node, error) {
+	seeds, err := k.Find(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	nodes, _, _, err := k.iterate(ctx, target, "", seeds, nil)
+	return nodes, err
+}
+
+// walkTopic drives the same round-based schedule as Lookup, but instead of
+// stopping at the k closest it calls onVisit for every node that responds,
+// so a topic search can query each one in turn. It runs until the shortlist
+// is exhausted or ctx is done.
+func (k *Kbucket) walkTopic(ctx context.Context, target NodeID, seeds []Node, onVisit func(Node)) {
+	k.iterate(ctx, target, "", seeds, onVisit)
+}
+
+// LookupValue runs the same iterative schedule as Lookup but short-circuits
+// on the first node that returns a value for key, caching the result at the
+// closest queried node that did not have it.
+func (k *Kbucket) LookupValue(ctx context.Context, key string) (string, bool, error) {
+	target, err := hashKey(key)
+	if err != nil {
+		return "", false, err
+	}
+	seeds, err := k.Find(ctx, target)
+	if err != nil {
+		return "", false, err
+	}
+	_, value, found, err := k.iterate(ctx, target, key, seeds, nil)
+	return value, found, err
+}
+
+// iterate runs the round-based shortlist schedule shared by Lookup,
+// LookupValue and walkTopic. key is empty for a plain node lookup; when it
+// is set, the lookup ends after the first round in which a responder
+// reports Found. onVisit, if non-nil, is called for every node that
+// responds in a round, and the walk then skips the k-closest stop and only
+// ends once no pending candidate is left.
+func (k *Kbucket) iterate(ctx context.Context, target NodeID, key string, seeds []Node, onVisit func(Node)) ([]Node, string, bool, error) {
+	candidates := make(map[NodeID]*lookupCandidate, len(seeds))
+	addCandidate := func(n Node) {
+		if _, ok := candidates[n.ID]; ok {
+			return
+		}
+		dist, err := CalDistance(n.ID, target)
+		if err != nil {
+			golog.Error(err)
+			return
+		}
+		candidates[n.ID] = &lookupCandidate{node: n, distance: dist, state: lookupPending}
+	}
+	for _, n := range seeds {
+		addCandidate(n)
+	}
+	if len(candidates) == 0 {
+		return nil, "", false, errors.New("Lookup: no known nodes to start from")
+	}
+
+	sorted := func() []*lookupCandidate {
+		list := make([]*lookupCandidate, 0, len(candidates))
+		for _, c := range candidates {
+			list = append(list, c)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].distance.Compare(list[j].distance) < 0
+		})
+		return list
+	}
+	closest := func(list []*lookupCandidate) *lookupCandidate {
+		for _, c := range list {
+			if c.state == lookupResponded {
+				return c
+			}
+		}
+		return nil
+	}
+
+	var closestWithout *lookupCandidate
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, "", false, ctx.Err()
+		default:
+		}
+		list := sorted()
+		outstanding := 0
+		for _, c := range list {
+			if c.state == lookupQueried {
+				outstanding++
+			}
+		}
+		var toQuery []*lookupCandidate
+		for _, c := range list {
+			if outstanding+len(toQuery) >= k.alpha {
+				break
+			}
+			if c.state == lookupPending {
+				toQuery = append(toQuery, c)
+			}
+		}
+		if len(toQuery) == 0 {
+			break
+		}
+		best := closest(list)
+
+		results := make(chan lookupResult, len(toQuery))
+		var wg sync.WaitGroup
+		for _, c := range toQuery {
+			c.state = lookupQueried
+			wg.Add(1)
+			go func(c *lookupCandidate) {
+				defer wg.Done()
+				reply, err := k.queryNode(ctx, c.node, target, key)
+				results <- lookupResult{id: c.node.ID, reply: reply, err: err}
+			}(c)
+		}
+		wg.Wait()
+		close(results)
+
+		var foundValue string
+		found := false
+		for r := range results {
+			c := candidates[r.id]
+			if r.err != nil {
+				c.state = lookupFailed
+				continue
+			}
+			c.state = lookupResponded
+			if onVisit != nil {
+				onVisit(c.node)
+			}
+			if key != "" && r.reply.Found {
+				foundValue = r.reply.Value
+				found = true
+				continue
+			}
+			if key != "" && (closestWithout == nil || c.distance.Compare(closestWithout.distance) < 0) {
+				closestWithout = c
+			}
+			for _, n := range r.reply.Nodes {
+				addCandidate(n)
+			}
+		}
+		if found {
+			if closestWithout != nil {
+				go k.cacheStore(closestWithout.node, key, foundValue)
+			}
+			return nil, foundValue, true, nil
+		}
+
+		newBest := closest(sorted())
+		progressed := (best == nil) != (newBest == nil)
+		if best != nil && newBest != nil && newBest.distance.Compare(best.distance) < 0 {
+			progressed = true
+		}
+		if onVisit == nil && !progressed && kClosestResponded(sorted(), k.k) {
+			break
+		}
+	}
+
+	final := sorted()
+	out := make([]Node, 0, k.k)
+	for _, c := range final {
+		if c.state != lookupResponded {
+			continue
+		}
+		out = append(out, c.node)
+		if len(out) == k.k {
+			break
+		}
+	}
+	return out, "", false, nil
+}
+
+// OnFind answers an incoming MailFind from requester, for the transport
+// layer to call when a peer's wire-level FIND reaches us. requester goes
+// through the same add/bond path as any other unverified sender (see
+// Kbucket.add) before the reply is computed; as with add, the reply is
+// still served right away regardless of whether the bond completes, the
+// same as any Kademlia node answering a stranger's query.
+func (k *Kbucket) OnFind(ctx context.Context, requester Node, target NodeID, key string) (findReply, error) {
+	if err := k.AddNode(ctx, requester); err != nil {
+		golog.Error(err)
+	}
+	ns, err := k.Find(ctx, target)
+	if err != nil {
+		return findReply{}, err
+	}
+	reply := findReply{Nodes: ns}
+	if key != "" {
+		if value, found, err := k.localValue(ctx, key); err != nil {
+			golog.Error(err)
+		} else {
+			reply.Value = value
+			reply.Found = found
+		}
+	}
+	return reply, nil
+}
+
+func (k *Kbucket) queryNode(ctx context.Context, n Node, target NodeID, key string) (findReply, error) {
+	res, err := k.send(ctx, MailFind, []interface{}{n, target, key})
+	if err != nil {
+		return findReply{}, err
+	}
+	reply, ok := res.(findReply)
+	if !ok {
+		return findReply{}, errors.New("Lookup: malformed find response")
+	}
+	return reply, nil
+}
+
+func (k *Kbucket) cacheStore(n Node, key, value string) {
+	if _, err := k.send(context.Background(), MailStore, []interface{}{n, key, value, defaultCacheTTL}); err != nil {
+		golog.Error(err)
+	}
+}
+
+func kClosestResponded(sorted []*lookupCandidate, k int) bool {
+	n := 0
+	for _, c := range sorted {
+		if n >= k {
+			break
+		}
+		if c.state != lookupResponded {
+			return false
+		}
+		n++
+	}
+	return n > 0
+}
+
+func hashKey(key string) (NodeID, error) {
+	sum := sha1.Sum([]byte(key))
+	return NodeIDFromBytes(sum[:])
+}
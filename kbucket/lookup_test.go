@@ -0,0 +1,30 @@
+package kbucket
+
+import "testing"
+
+func TestKClosestRespondedFalseIfAnyOfKFailed(t *testing.T) {
+	list := []*lookupCandidate{
+		{state: lookupResponded},
+		{state: lookupFailed},
+	}
+	if kClosestResponded(list, 2) {
+		t.Fatal("expected false: one of the k closest has not responded")
+	}
+}
+
+func TestKClosestRespondedTrueWhenKHaveResponded(t *testing.T) {
+	list := []*lookupCandidate{
+		{state: lookupResponded},
+		{state: lookupResponded},
+		{state: lookupPending},
+	}
+	if !kClosestResponded(list, 2) {
+		t.Fatal("expected true: the 2 closest have both responded")
+	}
+}
+
+func TestKClosestRespondedFalseWhenEmpty(t *testing.T) {
+	if kClosestResponded(nil, 2) {
+		t.Fatal("expected false for an empty shortlist")
+	}
+}
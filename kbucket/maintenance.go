@@ -0,0 +1,136 @@
+package kbucket
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	//bucketRefreshInterval is how long a bucket can go without serving a
+	//lookup before it is refreshed with a random lookup into its range.
+	bucketRefreshInterval = time.Minute
+
+	//minLivenessChecks is how many successful pongs a node needs before
+	//it is surfaced from find/findOne; below that it is only kept as a
+	//replacement candidate, which keeps a freshly (and maybe falsely)
+	//bonded node from being handed out to other peers right away.
+	minLivenessChecks = 1
+)
+
+// verified reports whether nid has passed enough liveness checks to be
+// handed out to callers of find/findOne.
+func (k *Kbucket) verified(nid NodeID) bool {
+	m := k.meta[nid]
+	return m != nil && m.livenessChecks >= minLivenessChecks
+}
+
+// onlyVerified filters ns down to the nodes that are allowed to leave the
+// table; the rest stay in routes as replacement candidates.
+func (k *Kbucket) onlyVerified(ns []Node) []Node {
+	out := make([]Node, 0, len(ns))
+	for _, n := range ns {
+		if k.verified(n.ID) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// refreshStale runs a lookup against a random ID in every partition that
+// hasn't served a lookup within bucketRefreshInterval, so buckets for
+// distant, rarely-contacted regions of the ID space don't go stale.
+func (k *Kbucket) refreshStale() {
+	now := time.Now()
+	for partion := range k.routes {
+		if last, ok := k.lastRefresh[partion]; ok && now.Sub(last) < bucketRefreshInterval {
+			continue
+		}
+		k.lastRefresh[partion] = now
+		target, err := randomIDInPartition(k.Self.ID, partion)
+		if err != nil {
+			golog.Error(err)
+			continue
+		}
+		go func() {
+			if _, err := k.Lookup(context.Background(), target); err != nil {
+				golog.Error(err)
+			}
+		}()
+	}
+}
+
+// randomIDInPartition returns a random NodeID whose distance from base
+// falls in the given bucket partition, i.e. it differs from base at that
+// bit and is random below it.
+func randomIDInPartition(base NodeID, partion int) (NodeID, error) {
+	var id NodeID
+	copy(id[:], base[:])
+	byteIdx := partion / 8
+	bitIdx := uint(7 - partion%8)
+	id[byteIdx] ^= 1 << bitIdx
+	if byteIdx+1 < len(id) {
+		if _, err := rand.Read(id[byteIdx+1:]); err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+// evictOrTouch resolves the contention between a full bucket's
+// least-recently-seen occupant (lru) and a newcomer by pinging lru: a
+// failed ping means lru is actually gone and newcomer takes its place;
+// a successful one means lru is alive and stays, with newcomer kept only
+// as a replacement candidate.
+func (k *Kbucket) evictOrTouch(partion int, lru, newcomer Node) {
+	if _, err := k.send(context.Background(), MailPing, []interface{}{lru}); err != nil {
+		k.emit(note{typ: nEvict, arg: evictArg{partion: partion, stale: lru, fresh: newcomer}})
+		return
+	}
+	k.emit(note{typ: nTouch, arg: touchArg{partion: partion, stale: lru, fresh: newcomer}})
+}
+
+type evictArg struct {
+	partion int
+	stale   Node
+	fresh   Node
+}
+
+type touchArg struct {
+	partion int
+	stale   Node
+	fresh   Node
+}
+
+// handleEvict carries out the replacement decided by evictOrTouch: stale is
+// dropped from its bucket and counted as a ping failure rather than having
+// its meta wiped outright, so its database record survives until it has
+// failed evictAfterFails pings in a row (a successful pong, including one
+// from re-bonding, resets that streak); fresh takes its slot.
+func (k *Kbucket) handleEvict(a evictArg) {
+	que, ok := k.routes[a.partion]
+	if !ok {
+		return
+	}
+	que.remove(a.stale)
+	k.recordPingFailure(a.stale.ID)
+	qptr := &que
+	qptr.updateAdd(a.fresh)
+	k.routes[a.partion] = que
+	if _, ok := k.meta[a.fresh.ID]; !ok {
+		k.meta[a.fresh.ID] = &nodeMeta{addedAt: time.Now()}
+	}
+}
+
+func (k *Kbucket) handleTouch(a touchArg) {
+	k.recordPongFrom(a.stale.ID)
+	que, ok := k.routes[a.partion]
+	if !ok {
+		return
+	}
+	que.touch(a.stale)
+	que.addReplacement(a.fresh)
+	k.routes[a.partion] = que
+}
@@ -0,0 +1,187 @@
+package kbucket
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+
+	"github.com/ZhangTao1596/kad/nodedb"
+)
+
+var errInvalidNodeIDLength = errors.New("nodedb: invalid NodeID length")
+
+// nodeMeta is the liveness bookkeeping kept for every committed node,
+// mirrored into the node database so the table can recover across restarts
+// without re-bootstrapping from the configured seeds every time.
+type nodeMeta struct {
+	failCount      int
+	addedAt        time.Time
+	lastPing       time.Time
+	lastPong       time.Time
+	livenessChecks uint
+}
+
+const (
+	defaultSeedCount  = 16
+	defaultSeedMaxAge = 7 * 24 * time.Hour
+
+	//evictAfterFails is how many consecutive ping failures a node must
+	//rack up before its record is dropped from the database; a node
+	//merely evicted from its KQue stays seedable until then.
+	evictAfterFails = 5
+)
+
+// seed reseeds empty partitions from the node database before falling back
+// to config.Seeds, dropping anything older than SeedMaxAge.
+func (k *Kbucket) seed() {
+	count := k.config.SeedCount
+	if count <= 0 {
+		count = defaultSeedCount
+	}
+	maxAge := k.config.SeedMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultSeedMaxAge
+	}
+	if k.db != nil {
+		records, err := k.db.Seed(count, maxAge)
+		if err != nil {
+			golog.Error(err)
+		}
+		for _, r := range records {
+			nid, err := NodeIDFromBytes(r.NodeID)
+			if err != nil {
+				golog.Error(err)
+				continue
+			}
+			k.AddNode(context.Background(), NewNode(nid, net.ParseIP(r.IP), r.Port))
+		}
+		if len(records) > 0 {
+			return
+		}
+	}
+	for _, addr := range k.config.Seeds {
+		n, err := parseSeedAddr(addr)
+		if err != nil {
+			golog.Error("[kbucket.seed] ", err)
+			continue
+		}
+		golog.Info("[kbucket.seed] seeding from config: ", addr)
+		k.AddNode(context.Background(), n)
+	}
+}
+
+// parseSeedAddr parses a config.Seeds entry of the form "<hex nodeid>@host:port"
+// into the Node it names.
+func parseSeedAddr(addr string) (Node, error) {
+	idHex, hostport, ok := strings.Cut(addr, "@")
+	if !ok {
+		return Node{}, fmt.Errorf("kbucket: malformed seed %q, want id@host:port", addr)
+	}
+	idBytes, err := hex.DecodeString(idHex)
+	if err != nil {
+		return Node{}, err
+	}
+	nid, err := NodeIDFromBytes(idBytes)
+	if err != nil {
+		return Node{}, err
+	}
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return Node{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Node{}, fmt.Errorf("kbucket: invalid seed ip %q", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return Node{}, err
+	}
+	return NewNode(nid, ip, uint32(port)), nil
+}
+
+// flush writes every committed node's current metadata to the database.
+// It is a no-op when no PersistPath was configured.
+func (k *Kbucket) flush() {
+	if k.db == nil {
+		return
+	}
+	for _, que := range k.routes {
+		for _, n := range que.All() {
+			m := k.meta[n.ID]
+			if m == nil {
+				continue
+			}
+			err := k.db.Put(nodedb.Record{
+				NodeID:    NodeIDBytes(n.ID),
+				IP:        n.IP.String(),
+				Port:      n.Port,
+				LastPong:  m.lastPong,
+				LastPing:  m.lastPing,
+				FailCount: m.failCount,
+				AddedAt:   m.addedAt,
+			})
+			if err != nil {
+				golog.Error(err)
+			}
+		}
+	}
+}
+
+// recordPongFrom marks n as having just proven liveness, resetting its
+// failure streak.
+func (k *Kbucket) recordPongFrom(nid NodeID) {
+	m := k.meta[nid]
+	if m == nil {
+		m = &nodeMeta{addedAt: time.Now()}
+		k.meta[nid] = m
+	}
+	m.lastPong = time.Now()
+	m.failCount = 0
+	m.livenessChecks++
+}
+
+// recordPingFailure increments n's failure streak and, once it crosses
+// evictAfterFails, drops it from the database. A node can be dropped from
+// its KQue long before that without losing its seed entry, so a flapping
+// link doesn't force a full re-bootstrap.
+func (k *Kbucket) recordPingFailure(nid NodeID) {
+	m := k.meta[nid]
+	if m == nil {
+		m = &nodeMeta{addedAt: time.Now()}
+		k.meta[nid] = m
+	}
+	m.lastPing = time.Now()
+	m.failCount++
+	if m.failCount < evictAfterFails || k.db == nil {
+		return
+	}
+	if err := k.db.Delete(NodeIDBytes(nid)); err != nil {
+		golog.Error(err)
+	}
+	delete(k.meta, nid)
+}
+
+// NodeIDBytes and NodeIDFromBytes round-trip a NodeID through the raw bytes
+// the node database stores it as.
+func NodeIDBytes(id NodeID) []byte {
+	b := make([]byte, len(id))
+	copy(b, id[:])
+	return b
+}
+
+func NodeIDFromBytes(b []byte) (NodeID, error) {
+	var id NodeID
+	if len(b) != len(id) {
+		return id, errInvalidNodeIDLength
+	}
+	copy(id[:], b)
+	return id, nil
+}
@@ -0,0 +1,288 @@
+package kbucket
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	//defaultRepublishInterval is how often the originator of a key re-runs
+	//the replication fan-out, absent a KbConfig override.
+	defaultRepublishInterval = 24 * time.Hour
+
+	//defaultReplicateInterval is how often a non-originator holder of a
+	//key re-runs the fan-out, absent a KbConfig override. It is shorter
+	//than defaultRepublishInterval because a holder has no guarantee any
+	//other holder is still alive to do it instead.
+	defaultReplicateInterval = time.Hour
+
+	//defaultCacheTTL is the TTL given to a value cached at a queried node
+	//along a LookupValue path; it's deliberately shorter than a typical
+	//Store TTL since a cached copy is a lookup-path optimization, not a
+	//durability guarantee.
+	defaultCacheTTL = time.Hour
+
+	//storeRoundTimeout bounds a single replication round (lookup plus the
+	//resulting fan-out) so a stalled peer can't wedge it past the next
+	//scheduled round.
+	storeRoundTimeout = 30 * time.Second
+)
+
+// storageEntry is one value held by Storage, expiring at expiresAt.
+type storageEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+	index     int
+}
+
+// expiryHeap is a min-heap of storageEntry ordered by expiresAt, letting
+// Storage.expire drop everything past its TTL in O(log n) per entry
+// instead of scanning the whole table on every tick.
+type expiryHeap []*storageEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i]; h[i].index, h[j].index = i, j }
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*storageEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// Storage is the local key/value store backing Kbucket.Store/Get. Every
+// entry carries a TTL; expire drops whatever has passed it. It has its own
+// lock because replicateKey reads it from a goroutine outside the run loop.
+type Storage struct {
+	mu      sync.Mutex
+	entries map[string]*storageEntry
+	expiry  expiryHeap
+}
+
+// NewStorage creates an empty Storage.
+func NewStorage() *Storage {
+	return &Storage{entries: make(map[string]*storageEntry)}
+}
+
+// Put stores value under key with the given ttl, replacing anything
+// already there.
+func (s *Storage) Put(key, value string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt := time.Now().Add(ttl)
+	if e, ok := s.entries[key]; ok {
+		e.value = value
+		e.expiresAt = expiresAt
+		heap.Fix(&s.expiry, e.index)
+		return
+	}
+	e := &storageEntry{key: key, value: value, expiresAt: expiresAt}
+	s.entries[key] = e
+	heap.Push(&s.expiry, e)
+}
+
+// Get returns the value stored under key, if any and not yet expired.
+func (s *Storage) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		return "", false
+	}
+	return e.value, true
+}
+
+// expire drops every entry whose TTL has passed and returns their keys, so
+// callers can also drop any bookkeeping they keep keyed alongside Storage
+// (see Kbucket.storeMeta).
+func (s *Storage) expire() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var expired []string
+	for s.expiry.Len() > 0 && now.After(s.expiry[0].expiresAt) {
+		e := heap.Pop(&s.expiry).(*storageEntry)
+		delete(s.entries, e.key)
+		expired = append(expired, e.key)
+	}
+	return expired
+}
+
+// storeMeta is the replication bookkeeping kept alongside a locally-held
+// key, separate from the value itself so a replicateKey round only ever
+// needs the key and its ttl, not a lock on this map.
+type storeMeta struct {
+	ttl        time.Duration
+	originator bool
+	lastSeen   time.Time
+}
+
+// storeArg is the note payload for both Store (originator true) and
+// OnStore (an incoming replica from a peer, originator false). from is
+// only set for OnStore, where it is the sender storeKV needs to bond.
+type storeArg struct {
+	key        string
+	value      string
+	ttl        time.Duration
+	originator bool
+	from       Node
+}
+
+type getResult struct {
+	value string
+	found bool
+}
+
+// Store puts (key, value) in the local table with the given ttl and, as
+// the originator, immediately fans it out to the k nodes closest to key.
+// It then keeps re-running that fan-out every RepublishInterval so the
+// value survives churn in the nodes holding it.
+func (k *Kbucket) Store(ctx context.Context, key, value string, ttl time.Duration) error {
+	select {
+	case k.receiver <- note{
+		typ: nStore,
+		arg: storeArg{key: key, value: value, ttl: ttl, originator: true},
+		ctx: ctx,
+	}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-k.closed:
+		return ErrClosed
+	}
+}
+
+// OnStore records an incoming replica of key from the wire, for the
+// transport layer to call when a peer's MailStore reaches us. from is the
+// transport layer's wire-level view of the sender; like any other
+// unverified sender it only goes through add/bond, never straight into
+// routes, so a forged STORE can't get its source address committed.
+// Unlike Store, this never triggers an immediate fan-out of its own; it
+// only resets key's replicate clock, deferring this node's own
+// re-replication for as long as some other holder keeps doing it instead.
+func (k *Kbucket) OnStore(from Node, key, value string, ttl time.Duration) {
+	k.emit(note{typ: nStore, arg: storeArg{key: key, value: value, ttl: ttl, from: from}})
+}
+
+func (k *Kbucket) storeKV(a storeArg) {
+	if !a.originator {
+		k.add(a.from)
+	}
+	k.store.Put(a.key, a.value, a.ttl)
+	m, ok := k.storeMeta[a.key]
+	if !ok {
+		m = &storeMeta{}
+		k.storeMeta[a.key] = m
+	}
+	m.lastSeen = time.Now()
+	if a.ttl > 0 {
+		m.ttl = a.ttl
+	}
+	if a.originator {
+		m.originator = true
+		go k.replicateKey(a.key, m.ttl)
+	}
+}
+
+// Get looks up key in the local store first, falling back to an iterative
+// LookupValue search of the network if it isn't held locally.
+func (k *Kbucket) Get(ctx context.Context, key string) (string, bool, error) {
+	value, found, err := k.localValue(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if found {
+		return value, true, nil
+	}
+	return k.LookupValue(ctx, key)
+}
+
+// localValue answers a key lookup from this node's own Storage only, with
+// none of Get's network fallback; OnFind uses this to answer a remote
+// peer's FIND without triggering a recursive lookup of its own.
+func (k *Kbucket) localValue(ctx context.Context, key string) (string, bool, error) {
+	phone := make(chan interface{})
+	select {
+	case k.receiver <- note{typ: nGet, arg: key, result: phone, ctx: ctx}:
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	case <-k.closed:
+		return "", false, ErrClosed
+	}
+	select {
+	case result, ok := <-phone:
+		if !ok {
+			return "", false, nil
+		}
+		gr := result.(getResult)
+		return gr.value, gr.found, nil
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	}
+}
+
+func (k *Kbucket) getLocal(key string, phone chan interface{}) {
+	defer close(phone)
+	value, found := k.store.Get(key)
+	phone <- getResult{value: value, found: found}
+}
+
+// replicateDue runs on the maintenance ticker and re-fans-out every key
+// whose replicate clock has lapsed: RepublishInterval for the originator,
+// the shorter ReplicateInterval for a non-originator holder. A holder's
+// clock is pushed back every time the key arrives again via OnStore, which
+// is what suppresses duplicate replication while another holder is active.
+func (k *Kbucket) replicateDue() {
+	now := time.Now()
+	for key, m := range k.storeMeta {
+		interval := k.replicateInterval
+		if m.originator {
+			interval = k.republishInterval
+		}
+		if now.Sub(m.lastSeen) < interval {
+			continue
+		}
+		m.lastSeen = now
+		go k.replicateKey(key, m.ttl)
+	}
+}
+
+// replicateKey runs an iterative Lookup for key and issues a MailStore to
+// each of the k closest nodes it returns. It is the mechanism Store's
+// initial fan-out and the periodic republish/replicate sweep both use.
+func (k *Kbucket) replicateKey(key string, ttl time.Duration) {
+	value, ok := k.store.Get(key)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeRoundTimeout)
+	defer cancel()
+	target, err := hashKey(key)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	nodes, err := k.Lookup(ctx, target)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	for _, n := range nodes {
+		if _, err := k.send(ctx, MailStore, []interface{}{n, key, value, ttl}); err != nil {
+			golog.Error(err)
+		}
+	}
+}
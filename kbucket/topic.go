@@ -0,0 +1,320 @@
+package kbucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	// topicRefreshInterval is how often RegisterTopic re-announces self at
+	// the nodes closest to a topic's hash; topicRefreshJitter spreads those
+	// re-announces out so every registrant on a topic doesn't hammer the
+	// same k nodes in lockstep.
+	topicRefreshInterval = 30 * time.Minute
+	topicRefreshJitter   = 5 * time.Minute
+
+	// topicSearchInterval and topicSearchJitter pace SearchTopic's repeat
+	// lookups the same way, on a shorter cycle since a searcher wants to
+	// notice newly-registered advertisers sooner than a registrant needs
+	// to refresh its own.
+	topicSearchInterval = 5 * time.Minute
+	topicSearchJitter   = time.Minute
+
+	// topicRoundTimeout bounds a single announce or search round so a
+	// stalled lookup can't wedge the caller's goroutine past the next
+	// scheduled round.
+	topicRoundTimeout = 30 * time.Second
+
+	// topicAdWindow is the sliding window an advertisement stays live for
+	// after being (re)stored; an advertiser that stops refreshing ages out
+	// instead of lingering forever.
+	topicAdWindow = 2 * topicRefreshInterval
+
+	// topicMaxAds caps how many advertisements a single topic holds at
+	// once, regardless of how many distinct nodes sent them, so a swarm of
+	// sybils can't grow one topic's queue without bound.
+	topicMaxAds = 200
+
+	// topicMaxAdsPerSender caps how many of those slots a single sender
+	// address can occupy, so one peer can't exhaust topicMaxAds by
+	// churning through fabricated NodeIDs; legitimate distinct advertisers
+	// always share the window.
+	topicMaxAdsPerSender = 3
+)
+
+// topicAd is one advertiser's live registration for a topic. sender is the
+// address it was actually stored from, kept alongside the claimed node so
+// an ad can be found and removed from its sender's quota.
+type topicAd struct {
+	node     Node
+	storedAt time.Time
+	sender   string
+}
+
+// topicState is the per-topic sliding window of advertisements kept on the
+// receiving side of RegisterTopic/SearchTopic. Ads are keyed by advertiser,
+// so a single node can only ever occupy one slot; topicMaxAds bounds the
+// total regardless of how many distinct nodes are advertising, and
+// bySender bounds how many of those a single sender address can hold.
+type topicState struct {
+	ads      map[NodeID]topicAd
+	bySender map[string][]NodeID
+}
+
+type topicStoreArg struct {
+	topic      string
+	node       Node
+	senderIP   net.IP
+	senderPort uint32
+}
+
+// senderAddr formats a sender's (IP, Port) as the key topicState rate-limits
+// advertisements by.
+func senderAddr(ip net.IP, port uint32) string {
+	return fmt.Sprintf("%s:%d", ip.String(), port)
+}
+
+// handleTopicStore records n's advertisement for topic. n's claimed (IP,
+// Port) must match the address the store actually arrived from — the same
+// binding an endpoint proof gives a routing-table entry — so a forged
+// advertisement can't be attributed to a different sender. Any existing
+// binding for n.ID is dropped first, including its bySender entry under
+// whatever sender stored it last, so a NodeID that re-advertises from a
+// new address (its own IP changing, say) doesn't leave a stale slot under
+// the old one. If the (possibly new) sender is already at
+// topicMaxAdsPerSender, its own stalest ad is evicted next; only then does
+// the topic-wide topicMaxAds limit apply.
+func (k *Kbucket) handleTopicStore(a topicStoreArg) {
+	if !a.node.IP.Equal(a.senderIP) || a.node.Port != a.senderPort {
+		return
+	}
+	ts, ok := k.topics[a.topic]
+	if !ok {
+		ts = &topicState{ads: make(map[NodeID]topicAd), bySender: make(map[string][]NodeID)}
+		k.topics[a.topic] = ts
+	}
+	sender := senderAddr(a.senderIP, a.senderPort)
+	removeAd(ts, a.node.ID)
+	if ids := ts.bySender[sender]; len(ids) >= topicMaxAdsPerSender {
+		removeAd(ts, ids[0])
+	}
+	if len(ts.ads) >= topicMaxAds {
+		evictOldestAd(ts)
+	}
+	ts.bySender[sender] = append(ts.bySender[sender], a.node.ID)
+	ts.ads[a.node.ID] = topicAd{node: a.node, storedAt: time.Now(), sender: sender}
+}
+
+// removeAd drops id's advertisement from both ts.ads and its sender's
+// bySender quota, keeping the two in sync.
+func removeAd(ts *topicState, id NodeID) {
+	ad, ok := ts.ads[id]
+	if !ok {
+		return
+	}
+	delete(ts.ads, id)
+	ids := ts.bySender[ad.sender]
+	for i, existing := range ids {
+		if existing.Equal(id) {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(ts.bySender, ad.sender)
+	} else {
+		ts.bySender[ad.sender] = ids
+	}
+}
+
+// evictOldestAd drops ts's stalest advertisement to make room for a new one.
+func evictOldestAd(ts *topicState) {
+	var oldest NodeID
+	var oldestAt time.Time
+	found := false
+	for id, ad := range ts.ads {
+		if !found || ad.storedAt.Before(oldestAt) {
+			oldest, oldestAt, found = id, ad.storedAt, true
+		}
+	}
+	if found {
+		removeAd(ts, oldest)
+	}
+}
+
+// topicAds replies on phone with the still-live advertisements known for
+// topic, dropping anything that has aged out of the sliding window.
+func (k *Kbucket) topicAds(topic string, phone chan interface{}) {
+	defer close(phone)
+	ts, ok := k.topics[topic]
+	if !ok {
+		phone <- []Node(nil)
+		return
+	}
+	now := time.Now()
+	out := make([]Node, 0, len(ts.ads))
+	for id, ad := range ts.ads {
+		if now.Sub(ad.storedAt) > topicAdWindow {
+			removeAd(ts, id)
+			continue
+		}
+		out = append(out, ad.node)
+	}
+	phone <- out
+}
+
+// OnTopicStore records an incoming rendezvous advertisement from n for
+// topic. The transport layer calls this when a peer's MailTopicStore
+// reaches us, passing the (IP, Port) the packet actually arrived from —
+// never the address n claims — so a forged advertisement can't be bound
+// to a sender it didn't come from.
+func (k *Kbucket) OnTopicStore(topic string, n Node, senderIP net.IP, senderPort uint32) {
+	k.emit(note{typ: nTopicStore, arg: topicStoreArg{topic: topic, node: n, senderIP: senderIP, senderPort: senderPort}})
+}
+
+// OnTopicQuery answers a peer's MailTopicQuery for topic with the
+// currently live advertisements, for the transport layer to write back
+// over the wire.
+func (k *Kbucket) OnTopicQuery(ctx context.Context, topic string) ([]Node, error) {
+	phone := make(chan interface{})
+	select {
+	case k.receiver <- note{typ: nTopicQuery, arg: topic, result: phone, ctx: ctx}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-k.closed:
+		return nil, ErrClosed
+	}
+	select {
+	case result, ok := <-phone:
+		if !ok {
+			return nil, errors.New("Failed")
+		}
+		return result.([]Node), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RegisterTopic advertises self at the k nodes closest to topic's hash so
+// a SearchTopic caller elsewhere in the network can find this node without
+// knowing its NodeID ahead of time. It re-announces on a jittered interval
+// and returns once stop is closed.
+func (k *Kbucket) RegisterTopic(topic string, stop <-chan struct{}) {
+	k.announceTopic(topic)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-k.closed:
+			return
+		case <-time.After(jitter(topicRefreshInterval, topicRefreshJitter)):
+			k.announceTopic(topic)
+		}
+	}
+}
+
+// announceTopic runs one round of RegisterTopic: an iterative lookup for
+// topic's hash, followed by a MailTopicStore to every node it turns up.
+func (k *Kbucket) announceTopic(topic string) {
+	ctx, cancel := context.WithTimeout(context.Background(), topicRoundTimeout)
+	defer cancel()
+	target, err := hashKey(topic)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	nodes, err := k.Lookup(ctx, target)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	for _, n := range nodes {
+		if _, err := k.send(ctx, MailTopicStore, []interface{}{n, topic, *k.Self}); err != nil {
+			golog.Error(err)
+		}
+	}
+}
+
+// SearchTopic drives repeated iterative lookups against topic's hash,
+// issuing a MailTopicQuery at every node it visits and streaming whatever
+// advertisements come back onto out, until stop is closed.
+func (k *Kbucket) SearchTopic(topic string, stop <-chan struct{}, out chan<- Node) {
+	target, err := hashKey(topic)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	for {
+		k.searchTopicOnce(topic, target, stop, out)
+		select {
+		case <-stop:
+			return
+		case <-k.closed:
+			return
+		case <-time.After(jitter(topicSearchInterval, topicSearchJitter)):
+		}
+	}
+}
+
+// searchTopicOnce runs a single SearchTopic round: seed from the local
+// table, then walk the shortlist, querying every node visited and
+// forwarding its advertisements onto out until the walk finishes, ctx
+// times out, or stop fires.
+func (k *Kbucket) searchTopicOnce(topic string, target NodeID, stop <-chan struct{}, out chan<- Node) {
+	ctx, cancel := context.WithTimeout(context.Background(), topicRoundTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	seeds, err := k.Find(ctx, target)
+	if err != nil {
+		return
+	}
+	k.walkTopic(ctx, target, seeds, func(n Node) {
+		ads, err := k.queryTopic(ctx, n, topic)
+		if err != nil {
+			return
+		}
+		for _, ad := range ads {
+			select {
+			case out <- ad:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// queryTopic sends a MailTopicQuery to n and returns the advertisements it
+// reports for topic.
+func (k *Kbucket) queryTopic(ctx context.Context, n Node, topic string) ([]Node, error) {
+	res, err := k.send(ctx, MailTopicQuery, []interface{}{n, topic})
+	if err != nil {
+		return nil, err
+	}
+	ads, ok := res.([]Node)
+	if !ok {
+		return nil, errors.New("SearchTopic: malformed topic query response")
+	}
+	return ads, nil
+}
+
+// jitter returns base plus a random duration in [0, spread).
+func jitter(base, spread time.Duration) time.Duration {
+	if spread <= 0 {
+		return base
+	}
+	return base + time.Duration(mrand.Int63n(int64(spread)))
+}
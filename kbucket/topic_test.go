@@ -0,0 +1,58 @@
+package kbucket
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandleTopicStoreRejectsSpoofedSender(t *testing.T) {
+	k := &Kbucket{topics: make(map[string]*topicState)}
+	n := nodeFor(1)
+
+	k.handleTopicStore(topicStoreArg{
+		topic:      "t",
+		node:       n,
+		senderIP:   net.ParseIP("9.9.9.9"),
+		senderPort: n.Port + 1,
+	})
+
+	if ts, ok := k.topics["t"]; ok && len(ts.ads) != 0 {
+		t.Fatal("advertisement whose claimed address doesn't match the sender should be dropped")
+	}
+}
+
+func TestHandleTopicStoreMovesSenderBindingOnReadvertise(t *testing.T) {
+	k := &Kbucket{topics: make(map[string]*topicState)}
+	id := idFor(1)
+	ip1, ip2 := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2")
+
+	k.handleTopicStore(topicStoreArg{topic: "t", node: NewNode(id, ip1, 1), senderIP: ip1, senderPort: 1})
+	k.handleTopicStore(topicStoreArg{topic: "t", node: NewNode(id, ip2, 1), senderIP: ip2, senderPort: 1})
+
+	ts := k.topics["t"]
+	if ids := ts.bySender["1.1.1.1:1"]; len(ids) != 0 {
+		t.Fatalf("expected the old sender's binding to be cleared, got %v", ids)
+	}
+	ids := ts.bySender["2.2.2.2:1"]
+	if len(ids) != 1 || !ids[0].Equal(id) {
+		t.Fatalf("expected the new sender to own the binding, got %v", ids)
+	}
+}
+
+func TestHandleTopicStoreCapsAdsPerSender(t *testing.T) {
+	k := &Kbucket{topics: make(map[string]*topicState)}
+	ip := net.ParseIP("3.3.3.3")
+
+	for i := 0; i < topicMaxAdsPerSender+1; i++ {
+		n := NewNode(idFor(byte(i)), ip, 1)
+		k.handleTopicStore(topicStoreArg{topic: "t", node: n, senderIP: ip, senderPort: 1})
+	}
+
+	ts := k.topics["t"]
+	if len(ts.bySender["3.3.3.3:1"]) != topicMaxAdsPerSender {
+		t.Fatalf("expected sender capped at %d ads, got %d", topicMaxAdsPerSender, len(ts.bySender["3.3.3.3:1"]))
+	}
+	if len(ts.ads) != topicMaxAdsPerSender {
+		t.Fatalf("expected %d total ads, got %d", topicMaxAdsPerSender, len(ts.ads))
+	}
+}
@@ -0,0 +1,105 @@
+// Package nodedb persists known-good Kademlia routing table entries across
+// restarts so a table doesn't have to re-bootstrap from scratch every time
+// the process starts.
+package nodedb
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var nodesBucket = []byte("nodes")
+
+// Record is the persisted view of a routing-table node.
+type Record struct {
+	NodeID    []byte
+	IP        string
+	Port      uint32
+	LastPong  time.Time
+	LastPing  time.Time
+	FailCount int
+	AddedAt   time.Time
+}
+
+// DB is an embedded key/value store of Records, keyed by NodeID.
+type DB struct {
+	bolt *bolt.DB
+}
+
+// Open opens (creating if necessary) the node database at path.
+func Open(path string) (*DB, error) {
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(nodesBucket)
+		return err
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return &DB{bolt: b}, nil
+}
+
+// Close closes the underlying store.
+func (d *DB) Close() error {
+	return d.bolt.Close()
+}
+
+// Put persists (or updates) r, keyed by r.NodeID.
+func (d *DB) Put(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).Put(r.NodeID, data)
+	})
+}
+
+// Delete removes the record for nodeID, if any.
+func (d *DB) Delete(nodeID []byte) error {
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).Delete(nodeID)
+	})
+}
+
+// Seed returns up to n records no older than maxAge, chosen uniformly at
+// random from the whole bucket via reservoir sampling, for reseeding an
+// empty routing table partition on startup. A plain cursor walk would
+// always return the same key-sorted prefix of the store.
+func (d *DB) Seed(n int, maxAge time.Duration) ([]Record, error) {
+	records := make([]Record, 0, n)
+	cutoff := time.Now().Add(-maxAge)
+	seen := 0
+	err := d.bolt.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(nodesBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				continue
+			}
+			if r.AddedAt.Before(cutoff) {
+				continue
+			}
+			seen++
+			if len(records) < n {
+				records = append(records, r)
+				continue
+			}
+			if i := rand.Intn(seen); i < n {
+				records[i] = r
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}